@@ -0,0 +1,73 @@
+package dchan
+
+import (
+	"sync"
+	"time"
+
+	"github.com/chzyer/next/packet"
+)
+
+// dedupWindow bounds how long a SeqID is remembered. duplicated-mode's
+// extra copies arrive within one round trip of the original, so this only
+// needs to outlast that, not the life of the session.
+const dedupWindow = 5 * time.Second
+
+// sessionDedup shares one SeqDedup across every Channel constructed for a
+// given *packet.Session, so duplicated-mode copies of the same packet
+// arriving on two different channels of the same Group still collapse to
+// a single delivery instead of each channel deduping only against itself.
+var sessionDedup = struct {
+	mu sync.Mutex
+	m  map[*packet.Session]*SeqDedup
+}{m: make(map[*packet.Session]*SeqDedup)}
+
+// dedupFor returns the SeqDedup shared by every Channel built on session,
+// creating it on first use.
+func dedupFor(session *packet.Session) *SeqDedup {
+	sessionDedup.mu.Lock()
+	defer sessionDedup.mu.Unlock()
+	d, ok := sessionDedup.m[session]
+	if !ok {
+		d = NewSeqDedup(dedupWindow)
+		sessionDedup.m[session] = d
+	}
+	return d
+}
+
+// SeqDedup recognises packet.SeqID values already delivered once, so a
+// receiver fed by a Group in duplicated send mode can drop the extra
+// copies that arrive from the other channels.
+type SeqDedup struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[uint64]time.Time
+}
+
+func NewSeqDedup(window time.Duration) *SeqDedup {
+	return &SeqDedup{
+		window: window,
+		seen:   make(map[uint64]time.Time),
+	}
+}
+
+// Seen reports whether seqID has already been passed to Seen within the
+// configured window, recording it as seen either way. Callers should drop
+// the packet when it returns true.
+func (d *SeqDedup) Seen(seqID uint64) bool {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for id, at := range d.seen {
+		if now.Sub(at) > d.window {
+			delete(d.seen, id)
+		}
+	}
+
+	if _, ok := d.seen[seqID]; ok {
+		return true
+	}
+	d.seen[seqID] = now
+	return false
+}
@@ -3,22 +3,69 @@ package dchan
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"fmt"
 	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"gopkg.in/logex.v1"
 
-	"github.com/chzyer/flow"
+	"github.com/chzyer/next/internal/service"
 	"github.com/chzyer/next/packet"
 	"github.com/chzyer/next/util"
 )
 
+// scoring weights for findUsefulLocked's composite score: latency and loss
+// rate. There's deliberately no in-flight term: nothing in this codebase
+// acks or dequeues a send, so a counter that only ever increments isn't a
+// "currently pending" measure, it's a monotonic send counter that would
+// permanently drag down every actively-used channel's score.
+const (
+	scoreAlpha = 0.7
+	scoreBeta  = 0.3
+
+	// ewmaWeight is how much a fresh sample moves the running average;
+	// 0.2 means roughly the last 5 samples dominate the score. A sample is
+	// taken on each updateUseful call (every 5s, and whenever a channel is
+	// added), not on every heartbeat.
+	ewmaWeight = 0.2
+
+	hedgeMultiplier = 1.5
+	duplicateTopK   = 2
+)
+
+// SendMode picks how Group.Send spreads a packet across its channels.
+type SendMode int
+
+const (
+	// SendLowestScore sends only on the top-ranked channel.
+	SendLowestScore SendMode = iota
+	// SendHedged sends on the top channel and, if the top channel's
+	// latency_ewma*hedgeMultiplier elapses without an Ack for the packet's
+	// SeqID, also sends on the second.
+	SendHedged
+	// SendDuplicated sends on the top duplicateTopK channels at once,
+	// for packets that can't afford to wait for a retransmit.
+	SendDuplicated
+)
+
+// ChanScore is the EWMA scoring state Group keeps per channel, exposed via
+// GetScores/GetStatsInfo. No shell subcommand renders it yet.
+type ChanScore struct {
+	Channel     *Channel
+	LatencyEWMA time.Duration
+	LossEWMA    float64
+	Score       float64
+}
+
 // Channel can't close by Group
 type Group struct {
-	flow          *flow.Flow
+	*service.BaseService
+	ctx context.Context
+
 	chanList      *list.List
 	chanListGuard sync.RWMutex
 
@@ -27,22 +74,63 @@ type Group struct {
 
 	usefulChans atomic.Value // []int
 	selectCase  []reflect.SelectCase
+
+	scores   map[*Channel]*ChanScore
+	sendMode SendMode
+
+	hedgeGuard   sync.Mutex
+	pendingHedge map[uint64]*time.Timer
 }
 
-func NewGroup(f *flow.Flow) *Group {
+func NewGroup() *Group {
 	newUseful := make(chan struct{}, 1)
 	g := &Group{
+		BaseService:     service.NewBaseService(),
 		chanList:        list.New(),
 		onNewUsefulChan: newUseful,
 		onNewUsefullCase: reflect.SelectCase{
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(newUseful),
 		},
+		scores:       make(map[*Channel]*ChanScore),
+		pendingHedge: make(map[uint64]*time.Timer),
 	}
-	f.ForkTo(&g.flow, g.Close)
 	return g
 }
 
+// sessionGroups lets a Channel's receive path route an incoming
+// packet.ACK back to the Group that sent the original packet, without
+// Channel needing a back-reference to its Group: every Channel a Group
+// manages shares one *packet.Session, so Bind registers that session as
+// the lookup key and ackFor (called from onRecePacket) finds it again.
+var sessionGroups = struct {
+	mu sync.Mutex
+	m  map[*packet.Session]*Group
+}{m: make(map[*packet.Session]*Group)}
+
+// Bind associates g with session, so acks the session's channels receive
+// reach g.Ack and cancel the matching pending hedge retransmit.
+func (g *Group) Bind(session *packet.Session) {
+	sessionGroups.mu.Lock()
+	sessionGroups.m[session] = g
+	sessionGroups.mu.Unlock()
+}
+
+// ackFor returns the Group bound to session, if any.
+func ackFor(session *packet.Session) *Group {
+	sessionGroups.mu.Lock()
+	defer sessionGroups.mu.Unlock()
+	return sessionGroups.m[session]
+}
+
+// SetSendMode switches how future Send calls spread packets across
+// channels. Safe to call while the group is running.
+func (g *Group) SetSendMode(mode SendMode) {
+	g.chanListGuard.Lock()
+	g.sendMode = mode
+	g.chanListGuard.Unlock()
+}
+
 func (g *Group) GetUsefulChan() []*Channel {
 	g.chanListGuard.RLock()
 	defer g.chanListGuard.RUnlock()
@@ -59,28 +147,53 @@ func (g *Group) GetUsefulChan() []*Channel {
 	return ret
 }
 
+// GetScores returns a snapshot of the current per-channel EWMA scores,
+// sorted best (lowest score) first. GetStatsInfo renders this; nothing
+// shell-facing does yet.
+func (g *Group) GetScores() []*ChanScore {
+	g.chanListGuard.RLock()
+	defer g.chanListGuard.RUnlock()
+
+	ret := make([]*ChanScore, 0, len(g.scores))
+	for _, sc := range g.scores {
+		cp := *sc
+		ret = append(ret, &cp)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Score < ret[j].Score })
+	return ret
+}
+
 func (g *Group) GetStatsInfo() string {
+	scores := make(map[*Channel]*ChanScore, len(g.scores))
+	for _, sc := range g.GetScores() {
+		scores[sc.Channel] = sc
+	}
+
 	g.chanListGuard.RLock()
 	defer g.chanListGuard.RUnlock()
 
 	buf := bytes.NewBuffer(nil)
 	for elem := g.chanList.Front(); elem != nil; elem = elem.Next() {
 		ch := elem.Value.(*Channel)
-		buf.WriteString(fmt.Sprintf("%v: %v\n",
-			ch.Name(), ch.GetStat().String(),
+		sc := scores[ch]
+		if sc == nil {
+			buf.WriteString(fmt.Sprintf("%v: %v score=n/a\n", ch.Name(), ch.GetStat().String()))
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%v: %v score=%.3f latency=%v loss=%.1f%%\n",
+			ch.Name(), ch.GetStat().String(), sc.Score, sc.LatencyEWMA, sc.LossEWMA*100,
 		))
 	}
 	return buf.String()
 }
 
-func (g *Group) Run() {
+// Start starts the group's background loop.
+func (g *Group) Start(ctx context.Context) {
+	g.ctx = g.BaseService.Start(ctx)
 	go g.loop()
 }
 
 func (g *Group) loop() {
-	g.flow.Add(1)
-	defer g.flow.DoneAndClose()
-
 	usefulTick := time.NewTicker(5 * time.Second)
 	defer usefulTick.Stop()
 
@@ -89,7 +202,7 @@ loop:
 		select {
 		case <-usefulTick.C:
 			g.updateUseful()
-		case <-g.flow.IsClose():
+		case <-g.ctx.Done():
 			break loop
 		}
 	}
@@ -100,34 +213,64 @@ type latencies struct {
 	Idx     int
 }
 
-func (g *Group) findUsefulLocked() []int {
-	idx := 0
-	infos := make([]*latencies, 0, g.chanList.Len())
-	var minLatency, maxLatency time.Duration
+// updateScoresLocked refreshes the EWMA latency/loss/score for every
+// channel that has reported a heartbeat recently, and drops scoring state
+// for channels that have since been removed from the group.
+func (g *Group) updateScoresLocked() {
+	live := make(map[*Channel]bool, g.chanList.Len())
 	for elem := g.chanList.Front(); elem != nil; elem = elem.Next() {
 		ch := elem.Value.(*Channel)
+		live[ch] = true
+
 		latency, lastCommit := ch.Latency()
 		if lastCommit >= 5*time.Second {
+			// Stale: this channel has stopped heartbeating (dead link,
+			// black hole). Drop its cached score rather than leaving
+			// findUsefulLocked to keep ranking it on a frozen last-known
+			// value forever.
+			delete(g.scores, ch)
 			continue
 		}
-		infos = append(infos, &latencies{
-			Idx:     idx,
-			Latency: latency,
-		})
-		if minLatency > latency || minLatency == 0 {
-			minLatency = latency
+
+		sc, ok := g.scores[ch]
+		if !ok {
+			sc = &ChanScore{Channel: ch, LatencyEWMA: latency}
+			g.scores[ch] = sc
 		}
-		if maxLatency < latency {
-			maxLatency = latency
+		sc.LatencyEWMA = time.Duration(ewmaWeight*float64(latency) + (1-ewmaWeight)*float64(sc.LatencyEWMA))
+		sc.LossEWMA = ewmaWeight*ch.GetStat().LossRate() + (1-ewmaWeight)*sc.LossEWMA
+		sc.Score = scoreAlpha*sc.LatencyEWMA.Seconds() + scoreBeta*sc.LossEWMA
+	}
+	for ch := range g.scores {
+		if !live[ch] {
+			delete(g.scores, ch)
+		}
+	}
+}
+
+func (g *Group) findUsefulLocked() []int {
+	g.updateScoresLocked()
+
+	idx := 0
+	infos := make([]*latencies, 0, g.chanList.Len())
+	for elem := g.chanList.Front(); elem != nil; elem = elem.Next() {
+		ch := elem.Value.(*Channel)
+		if sc := g.scores[ch]; sc != nil {
+			infos = append(infos, &latencies{Idx: idx, Latency: time.Duration(sc.Score * float64(time.Second))})
 		}
 		idx++
 	}
+	if len(infos) == 0 {
+		return nil
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Latency < infos[j].Latency })
+	best := infos[0].Latency
 
 	ret := make([]int, 0, len(infos))
-	// we have no choise
-	meanVal := (minLatency + maxLatency) / 2
 	for _, info := range infos {
-		if info.Latency <= meanVal || len(infos) <= 2 {
+		// we have no choise
+		if info.Latency <= 2*best || len(infos) <= 2 {
 			ret = append(ret, info.Idx)
 		}
 	}
@@ -157,7 +300,157 @@ func (g *Group) GetUseful() []int {
 	return useful.([]int)
 }
 
+// rankedLocked returns the useful channels' scores, best (lowest) first.
+// Must be called with chanListGuard held for reading.
+func (g *Group) rankedLocked() []*ChanScore {
+	useful := g.GetUseful()
+	ranked := make([]*ChanScore, 0, len(useful))
+	idx := 0
+	for elem := g.chanList.Front(); elem != nil; elem = elem.Next() {
+		if util.InInts(idx, useful) {
+			if sc := g.scores[elem.Value.(*Channel)]; sc != nil {
+				ranked = append(ranked, sc)
+			}
+		}
+		idx++
+	}
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].Score < ranked[j].Score })
+	return ranked
+}
+
 func (g *Group) Send(p *packet.Packet) {
+	g.chanListGuard.RLock()
+	mode := g.sendMode
+	g.chanListGuard.RUnlock()
+
+	switch mode {
+	case SendHedged:
+		g.sendHedged(p)
+	case SendDuplicated:
+		g.sendDuplicated(p)
+	default:
+		g.sendLowestScore(p)
+	}
+}
+
+// sendLowestScore sends only on the top-ranked channel, falling back to
+// the reflect.Select across every useful channel (the group's old default
+// behaviour) when no channel has been scored yet.
+func (g *Group) sendLowestScore(p *packet.Packet) {
+resend:
+	g.chanListGuard.RLock()
+	ranked := g.rankedLocked()
+	g.chanListGuard.RUnlock()
+
+	if len(ranked) == 0 {
+		g.sendFallback(p)
+		return
+	}
+
+	top := ranked[0]
+	select {
+	case top.Channel.ChanWrite() <- p:
+	case <-g.onNewUsefulChan:
+		goto resend
+	}
+}
+
+// sendHedged sends on the top channel and, if Ack hasn't been called for
+// p.SeqID within 1.5*latency_ewma, retransmits on the second-best channel.
+// The primary send gets the same select-against-onNewUsefulChan treatment
+// as sendLowestScore, rather than a bare blocking send, so a full top
+// channel can't wedge the caller forever.
+func (g *Group) sendHedged(p *packet.Packet) {
+resend:
+	g.chanListGuard.RLock()
+	ranked := g.rankedLocked()
+	g.chanListGuard.RUnlock()
+
+	if len(ranked) == 0 {
+		g.sendFallback(p)
+		return
+	}
+
+	top := ranked[0]
+	select {
+	case top.Channel.ChanWrite() <- p:
+	case <-g.onNewUsefulChan:
+		goto resend
+	}
+
+	if len(ranked) < 2 {
+		return
+	}
+	second := ranked[1]
+	timeout := time.Duration(float64(top.LatencyEWMA) * hedgeMultiplier)
+	if timeout <= 0 {
+		timeout = 100 * time.Millisecond
+	}
+
+	seqID := p.SeqID
+	timer := time.AfterFunc(timeout, func() {
+		g.hedgeGuard.Lock()
+		delete(g.pendingHedge, seqID)
+		g.hedgeGuard.Unlock()
+		select {
+		case second.Channel.ChanWrite() <- p:
+		default:
+		}
+	})
+	g.hedgeGuard.Lock()
+	g.pendingHedge[seqID] = timer
+	g.hedgeGuard.Unlock()
+}
+
+// Ack cancels the pending hedge retransmit for seqID, if any. Channels
+// route an incoming packet.ACK here via ackFor(session).Ack once g has
+// been associated with their shared session through Bind; without this
+// the hedge would unconditionally fire on every send regardless of
+// whether the original already got through.
+func (g *Group) Ack(seqID uint64) {
+	g.hedgeGuard.Lock()
+	timer, ok := g.pendingHedge[seqID]
+	if ok {
+		delete(g.pendingHedge, seqID)
+	}
+	g.hedgeGuard.Unlock()
+	if ok {
+		timer.Stop()
+	}
+}
+
+// sendDuplicated sends on the top duplicateTopK channels simultaneously,
+// for packets that can't afford to wait for a hedge or a retransmit. The
+// receiver dedups on packet.SeqID (see SeqDedup, wired into onRecePacket
+// in httpchan.go/quicchan.go) so the extra copies get dropped, not
+// delivered twice.
+func (g *Group) sendDuplicated(p *packet.Packet) {
+	g.chanListGuard.RLock()
+	ranked := g.rankedLocked()
+	g.chanListGuard.RUnlock()
+
+	if len(ranked) == 0 {
+		g.sendFallback(p)
+		return
+	}
+
+	k := duplicateTopK
+	if k > len(ranked) {
+		k = len(ranked)
+	}
+	for _, sc := range ranked[:k] {
+		select {
+		case sc.Channel.ChanWrite() <- p:
+		default:
+		}
+	}
+}
+
+// sendFallback is the group's original channel-agnostic send: race a
+// reflect.Select across every useful channel. Kept as a last resort for
+// when no channel has a score yet (e.g. right after AddWithAutoRemove,
+// before the first heartbeat has landed).
+func (g *Group) sendFallback(p *packet.Packet) {
 	pv := reflect.ValueOf(p)
 resend:
 	g.chanListGuard.RLock()
@@ -178,17 +471,23 @@ resend:
 	}
 }
 
-func (g *Group) AddWithAutoRemove(c *Channel) {
+// AddWithAutoRemove attaches c to the group and removes it again once c
+// stops. session is the *packet.Session shared by every channel this group
+// will ever hold (they're all channels to the same peer); AddWithAutoRemove
+// binds it to g so acks arriving on any of them reach g.Ack via ackFor.
+func (g *Group) AddWithAutoRemove(session *packet.Session, c *Channel) {
+	g.Bind(session)
 	logex.Info("new channel:", c.Name())
 	g.chanListGuard.Lock()
 	elem := g.chanList.PushFront(c)
 	g.makeSelectCaseLocked()
 	g.chanListGuard.Unlock()
 
-	c.AddOnClose(func() {
+	c.OnStop(func() {
 		logex.Info("remove channel:", c.Name())
 		g.chanListGuard.Lock()
 		g.chanList.Remove(elem)
+		delete(g.scores, c)
 		g.makeSelectCaseLocked()
 		g.chanListGuard.Unlock()
 	})
@@ -207,7 +506,3 @@ func (g *Group) makeSelectCaseLocked() {
 		idx++
 	}
 }
-
-func (g *Group) Close() {
-	g.flow.Close()
-}
@@ -0,0 +1,209 @@
+package dchan
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/packet"
+)
+
+const (
+	sessionKeySize  = 32 // AES-256-GCM key carried in the client hello
+	credentialSize  = 32 // HMAC-SHA256 tag proving knowledge of the user's PSK
+	clientHelloSize = 4 + sessionKeySize + 16 + 8 + credentialSize
+
+	// handshakeTimeout bounds how long a connection may sit unauthenticated
+	// before handshakeAndServe gives up; without it a client that never
+	// sends its hello pins a goroutine (and an unfinished HttpChan/QuicChan)
+	// forever.
+	handshakeTimeout = 10 * time.Second
+)
+
+// ClientHello is what the client RSA-encrypts with the server's public
+// key and sends back as its half of the handshake. RSA-OAEP only proves
+// the sender could reach the (freely broadcast) public key, not who they
+// are, so Credential is what actually ties UserId to this connection: an
+// HMAC-SHA256 over UserId||Nonce||Timestamp keyed by the pre-shared secret
+// packet.Session.PSK returns for that user. delegate.Authenticate must
+// recompute and compare it (with the PSK it looks up for UserId, not the
+// connecting client's say-so) before trusting UserId at all; Nonce still
+// lets it reject replays of a captured hello.
+type ClientHello struct {
+	UserId     int32
+	SessionKey [sessionKeySize]byte
+	Nonce      [16]byte
+	Timestamp  int64
+	Credential [credentialSize]byte
+}
+
+// credentialFor computes the HMAC-SHA256 tag a ClientHello's Credential
+// must match: proof the sender holds psk, the pre-shared secret for
+// userId, not merely that it could encrypt towards the server's public key.
+func credentialFor(psk []byte, userId int32, nonce [16]byte, timestamp int64) [credentialSize]byte {
+	mac := hmac.New(sha256.New, psk)
+	var idBuf [4]byte
+	binary.BigEndian.PutUint32(idBuf[:], uint32(userId))
+	mac.Write(idBuf[:])
+	mac.Write(nonce[:])
+	var tsBuf [8]byte
+	binary.BigEndian.PutUint64(tsBuf[:], uint64(timestamp))
+	mac.Write(tsBuf[:])
+	var out [credentialSize]byte
+	copy(out[:], mac.Sum(nil))
+	return out
+}
+
+// VerifyCredential reports whether c.Credential proves the sender holds
+// psk, the secret delegate.Authenticate looked up for c.UserId. Callers
+// must use hmac.Equal-style constant-time comparison, which this does
+// internally, rather than comparing the bytes themselves.
+func (c *ClientHello) VerifyCredential(psk []byte) bool {
+	want := credentialFor(psk, c.UserId, c.Nonce, c.Timestamp)
+	return hmac.Equal(want[:], c.Credential[:])
+}
+
+func (c *ClientHello) marshal() []byte {
+	buf := make([]byte, clientHelloSize)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(c.UserId))
+	copy(buf[4:4+sessionKeySize], c.SessionKey[:])
+	copy(buf[4+sessionKeySize:4+sessionKeySize+16], c.Nonce[:])
+	binary.BigEndian.PutUint64(buf[4+sessionKeySize+16:4+sessionKeySize+16+8], uint64(c.Timestamp))
+	copy(buf[4+sessionKeySize+16+8:], c.Credential[:])
+	return buf
+}
+
+// ParseClientHello decodes the plaintext layout a ClientHello is marshalled
+// to. Exported so a SvrInitDelegate.Authenticate implementation (which owns
+// the RSA private key and does the actual decryption) can turn the result
+// back into structured fields.
+func ParseClientHello(b []byte) (*ClientHello, error) {
+	if len(b) != clientHelloSize {
+		return nil, logex.NewErrorf("handshake: malformed client hello (%v bytes)", len(b))
+	}
+	c := &ClientHello{}
+	c.UserId = int32(binary.BigEndian.Uint32(b[0:4]))
+	copy(c.SessionKey[:], b[4:4+sessionKeySize])
+	copy(c.Nonce[:], b[4+sessionKeySize:4+sessionKeySize+16])
+	c.Timestamp = int64(binary.BigEndian.Uint64(b[4+sessionKeySize+16 : 4+sessionKeySize+16+8]))
+	copy(c.Credential[:], b[4+sessionKeySize+16+8:])
+	return c, nil
+}
+
+// DecryptClientHello RSA-decrypts blob with priv and parses the result,
+// the two steps a SvrInitDelegate.Authenticate implementation needs before
+// it can apply its own nonce replay check and hand back (userId, sessionKey).
+func DecryptClientHello(priv *rsa.PrivateKey, blob []byte) (*ClientHello, error) {
+	plain, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, blob, nil)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return ParseClientHello(plain)
+}
+
+// writeFrame/readFrame carry handshake messages before a packet.Session
+// cipher exists, so unlike everything after them they can't ride on
+// packet.WrapL2 yet: just a length-prefixed blob.
+func writeFrame(w io.Writer, data []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(data)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > 1<<20 {
+		return nil, logex.NewErrorf("handshake: frame too large (%v bytes)", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// serverHandshake runs before any L2 frame is trusted: it presents our
+// public key and hands whatever the client sends back to
+// delegate.Authenticate, which owns the private key, the nonce replay
+// cache, and — this is the part that actually authenticates the caller,
+// not just encrypts to them — looking up the PSK for the claimed UserId
+// and calling ClientHello.VerifyCredential before trusting it. A
+// successful RSA-OAEP decrypt only proves the sender could reach our
+// (publicly handed-out) key; only a matching Credential proves who sent it.
+func serverHandshake(ctx context.Context, w io.Writer, r *bufio.Reader, session *packet.Session, delegate SvrInitDelegate) (packet.SendChan, error) {
+	if err := writeFrame(w, delegate.PublicKey()); err != nil {
+		return nil, logex.Trace(err)
+	}
+	blob, err := readFrame(r)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	userId, sessionKey, err := delegate.Authenticate(ctx, blob)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	session.UseSessionKey(sessionKey)
+	out, err := delegate.Init(userId)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return out, nil
+}
+
+// clientHandshake is the client's half: read the server's public key,
+// RSA-encrypt a freshly generated session key together with our user id,
+// a nonce and an HMAC credential proving we hold that user's PSK, and
+// switch session over to that key once it's sent.
+func clientHandshake(w io.Writer, r *bufio.Reader, session *packet.Session) error {
+	pubBytes, err := readFrame(r)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(pubBytes)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return logex.NewErrorf("handshake: unexpected server public key type %T", pub)
+	}
+
+	hello := &ClientHello{
+		UserId:    int32(session.UserId()),
+		Timestamp: time.Now().Unix(),
+	}
+	if _, err := rand.Read(hello.SessionKey[:]); err != nil {
+		return logex.Trace(err)
+	}
+	if _, err := rand.Read(hello.Nonce[:]); err != nil {
+		return logex.Trace(err)
+	}
+	hello.Credential = credentialFor(session.PSK(), hello.UserId, hello.Nonce, hello.Timestamp)
+
+	blob, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPub, hello.marshal(), nil)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if err := writeFrame(w, blob); err != nil {
+		return logex.Trace(err)
+	}
+
+	session.UseSessionKey(hello.SessionKey[:])
+	return nil
+}
@@ -2,13 +2,14 @@ package dchan
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"strings"
 	"time"
 
-	"github.com/chzyer/flow"
 	"github.com/chzyer/logex"
+	"github.com/chzyer/next/internal/service"
 	"github.com/chzyer/next/packet"
 	"github.com/chzyer/next/statistic"
 )
@@ -20,49 +21,63 @@ var (
 
 // to simulate http interactive
 type HttpChan struct {
-	flow    *flow.Flow
+	*service.BaseService
+	ctx context.Context
+
 	session *packet.Session
 	conn    net.Conn
 
-	delegate     SvrInitDelegate
-	waitInitChan chan struct{}
+	delegate   SvrInitDelegate
+	initCtx    context.Context
+	markInited context.CancelFunc
 
 	heartBeat *statistic.HeartBeatStage
 	speed     *statistic.Speed
-
-	exitError error
+	dedup     *SeqDedup
 
 	in  packet.Chan
 	out packet.SendChan
 }
 
-func NewHttpChanClient(f *flow.Flow, session *packet.Session, conn net.Conn, out packet.SendChan) *HttpChan {
-	hc := NewHttpChanServer(f, session, conn, nil)
+func NewHttpChanClient(session *packet.Session, conn net.Conn, out packet.SendChan) *HttpChan {
+	hc := NewHttpChanServer(session, conn, nil)
 	hc.markInit(out)
 	return hc
 }
 
-func NewHttpChanServer(f *flow.Flow, s *packet.Session, conn net.Conn, delegate SvrInitDelegate) *HttpChan {
+func NewHttpChanServer(s *packet.Session, conn net.Conn, delegate SvrInitDelegate) *HttpChan {
+	initCtx, markInited := context.WithCancel(context.Background())
 	hc := &HttpChan{
-		conn:         conn,
-		delegate:     delegate,
-		session:      s,
-		waitInitChan: make(chan struct{}, 1),
+		BaseService: service.NewBaseService(),
+		conn:        conn,
+		delegate:    delegate,
+		session:     s,
+		initCtx:     initCtx,
+		markInited:  markInited,
 
 		speed: statistic.NewSpeed(),
+		dedup: dedupFor(s),
 		in:    packet.NewChan(4),
 	}
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		tcpConn.SetNoDelay(false)
 	}
-	f.ForkTo(&hc.flow, hc.Close)
-	hc.heartBeat = statistic.NewHeartBeatStage(hc.flow, 5*time.Second, hc)
 	return hc
 }
 
-func (c *HttpChan) markInit(out packet.SendChan) {
-	c.out = out
-	c.waitInitChan <- struct{}{}
+func (h *HttpChan) markInit(out packet.SendChan) {
+	h.out = out
+	h.markInited()
+}
+
+// InitContext returns a context.Context that is done once markInit has been
+// called, letting callers wait on or race against readiness the same way
+// they would any other ctx. On the server side that happens after the
+// handshake has authenticated the peer; a client channel is marked in
+// NewHttpChanClient, so its InitContext is already done before the
+// handshake runs.
+func (h *HttpChan) InitContext() context.Context {
+	return h.initCtx
 }
 
 func (h *HttpChan) IsSvrModeAndUninit() bool {
@@ -74,13 +89,59 @@ func (h *HttpChan) GetSpeed() *statistic.SpeedInfo {
 }
 
 func (h *HttpChan) HeartBeatClean(err error) {
-	h.exitError = logex.NewErrorf("clean: %v", err)
-	h.Close()
+	h.SetError(logex.NewErrorf("clean: %v", err))
+	h.Stop()
+}
+
+// Start wires up ctx-dependent state (the heartbeat stage, the conn-close
+// OnStop hook) and kicks off the handshake, which hands off to the
+// read/write loops once it succeeds.
+func (h *HttpChan) Start(ctx context.Context) {
+	h.ctx = h.BaseService.Start(ctx)
+	h.heartBeat = statistic.NewHeartBeatStage(h.ctx, 5*time.Second, h)
+	h.OnStop(func() {
+		if err := h.Err(); err != nil {
+			logex.Info(h.Name(), "exit by:", err)
+		}
+		h.conn.Close()
+	})
+	go h.handshakeAndServe()
 }
 
-func (h *HttpChan) Run() {
+func (h *HttpChan) handshakeAndServe() {
+	buf := bufio.NewReader(h.conn)
+
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := h.ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	h.conn.SetReadDeadline(deadline)
+
+	if err := h.handshake(buf); err != nil {
+		h.SetError(logex.NewErrorf("handshake error: %v", err))
+		h.Stop()
+		return
+	}
+	h.conn.SetReadDeadline(time.Time{})
 	go h.writeLoop()
-	go h.readLoop()
+	h.readLoop(buf)
+}
+
+// handshake authenticates the connection before any L2 frame is trusted:
+// the server presents its public key and hands whatever comes back to
+// delegate.Authenticate, the client RSA-encrypts a fresh session key.
+// Either way session ends up carrying the negotiated AES cipher.
+func (h *HttpChan) handshake(buf *bufio.Reader) error {
+	if h.delegate != nil {
+		out, err := serverHandshake(h.ctx, h.conn, buf, h.session, h.delegate)
+		if err != nil {
+			return err
+		}
+		h.markInit(out)
+		h.delegate.OnInited(h)
+		return nil
+	}
+	return clientHandshake(h.conn, buf, h.session)
 }
 
 func (h *HttpChan) rawWrite(p []*packet.Packet) error {
@@ -91,13 +152,6 @@ func (h *HttpChan) rawWrite(p []*packet.Packet) error {
 }
 
 func (h *HttpChan) writeLoop() {
-	h.flow.Add(1)
-	defer h.flow.DoneAndClose()
-
-	if !h.flow.WaitNotify(h.waitInitChan) {
-		return
-	}
-
 	heartBeatTicker := time.NewTicker(1 * time.Second)
 	defer heartBeatTicker.Stop()
 
@@ -105,7 +159,7 @@ func (h *HttpChan) writeLoop() {
 loop:
 	for {
 		select {
-		case <-h.flow.IsClose():
+		case <-h.ctx.Done():
 			break loop
 		case <-heartBeatTicker.C:
 			p := h.heartBeat.New()
@@ -116,21 +170,22 @@ loop:
 		}
 		if err != nil {
 			if !strings.Contains(err.Error(), "closed") {
-				h.exitError = logex.NewErrorf("write error: %v", err)
+				h.SetError(logex.NewErrorf("write error: %v", err))
 			}
 			break
 		}
 	}
+	h.Stop()
 }
 
-func (h *HttpChan) readLoop() {
-	h.flow.Add(1)
-	defer h.flow.DoneAndClose()
-
-	buf := bufio.NewReader(h.conn)
+func (h *HttpChan) readLoop(buf *bufio.Reader) {
 loop:
-	for !h.flow.IsClosed() {
-		h.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for h.ctx.Err() == nil {
+		deadline := time.Now().Add(5 * time.Second)
+		if d, ok := h.ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		h.conn.SetReadDeadline(deadline)
 		l2, err := h.ReadL2(buf)
 		if err != nil {
 			if err, ok := err.(*net.OpError); ok {
@@ -139,35 +194,26 @@ loop:
 				}
 			}
 			if !strings.Contains(err.Error(), "closed") {
-				h.exitError = logex.NewErrorf("read error: %v", err)
+				h.SetError(logex.NewErrorf("read error: %v", err))
 			}
 			break
 		}
 
 		if err := l2.Verify(h.session); err != nil {
-			h.exitError = logex.NewErrorf("verify error: %v", err)
+			h.SetError(logex.NewErrorf("verify error: %v", err))
 			break
 		}
 
-		if h.IsSvrModeAndUninit() {
-			out, err := h.delegate.Init(int(l2.UserId))
-			if err != nil {
-				h.exitError = logex.NewErrorf("init error: %v", err)
-				break
-			}
-			h.markInit(out)
-			h.delegate.OnInited(h)
-		}
-
 		ps, err := l2.Unmarshal()
 		if err != nil {
-			h.exitError = logex.NewErrorf("client error: %v", err)
+			h.SetError(logex.NewErrorf("client error: %v", err))
 			break
 		}
 		if !h.onRecePacket(ps) {
 			break loop
 		}
 	}
+	h.Stop()
 }
 
 func (h *HttpChan) onRecePacket(ps []*packet.Packet) bool {
@@ -176,17 +222,27 @@ func (h *HttpChan) onRecePacket(ps []*packet.Packet) bool {
 		h.speed.Download(p.Size())
 		switch p.Type {
 		case packet.HEARTBEAT:
-			if !h.in.SendSafe(h.flow, []*packet.Packet{p.Reply(p.Payload())}) {
+			if !h.in.SendSafeCtx(h.ctx, []*packet.Packet{p.Reply(p.Payload())}) {
 				return false
 			}
 		case packet.HEARTBEAT_R:
 			h.heartBeat.Receive(p)
+		case packet.ACK:
+			if g := ackFor(h.session); g != nil {
+				g.Ack(p.SeqID)
+			}
 		default:
+			// Duplicated send mode can land the same SeqID on more than
+			// one of a Group's channels; drop the repeat rather than
+			// deliver it twice.
+			if h.dedup.Seen(p.SeqID) {
+				continue
+			}
 			buffer = append(buffer, p)
 		}
 	}
 
-	if !h.out.SendSafe(h.flow, buffer) {
+	if !h.out.SendSafeCtx(h.ctx, buffer) {
 		return false
 	}
 	return true
@@ -200,25 +256,6 @@ func (h *HttpChan) ChanWrite() packet.SendChan {
 	return h.in.Send()
 }
 
-func (h *HttpChan) AddOnClose(f func()) {
-	h.flow.AddOnClose(f)
-}
-
-func (h *HttpChan) Close() {
-	if !h.flow.MarkExit() {
-		return
-	}
-
-	if h.exitError != nil {
-		logex.Info(h.Name(), "exit by:", h.exitError)
-	} else {
-		// logex.Info(h.Name(), "exit manually")
-	}
-
-	h.flow.Close()
-	h.conn.Close()
-}
-
 func (h *HttpChan) GetUserId() (int, error) {
 	return h.session.UserId(), nil
 }
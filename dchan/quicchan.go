@@ -0,0 +1,299 @@
+package dchan
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/internal/service"
+	"github.com/chzyer/next/packet"
+	"github.com/chzyer/next/statistic"
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+var (
+	_ Channel        = new(QuicChan)
+	_ ChannelFactory = new(QuicChanFactory)
+)
+
+// QuicChan is the QUIC equivalent of HttpChan: instead of owning a raw
+// net.Conn it owns a single bidirectional stream of a quic.Session, so a
+// Group can hold several QuicChans multiplexed over one UDP flow.
+type QuicChan struct {
+	*service.BaseService
+	ctx context.Context
+
+	session *packet.Session
+	sess    quic.Session
+	stream  quic.Stream
+
+	delegate   SvrInitDelegate
+	initCtx    context.Context
+	markInited context.CancelFunc
+
+	heartBeat *statistic.HeartBeatStage
+	speed     *statistic.Speed
+	dedup     *SeqDedup
+
+	in  packet.Chan
+	out packet.SendChan
+}
+
+func NewQuicChanClient(session *packet.Session, sess quic.Session, stream quic.Stream, out packet.SendChan) *QuicChan {
+	qc := NewQuicChanServer(session, sess, stream, nil)
+	qc.markInit(out)
+	return qc
+}
+
+func NewQuicChanServer(s *packet.Session, sess quic.Session, stream quic.Stream, delegate SvrInitDelegate) *QuicChan {
+	initCtx, markInited := context.WithCancel(context.Background())
+	qc := &QuicChan{
+		BaseService: service.NewBaseService(),
+		sess:        sess,
+		stream:      stream,
+		delegate:    delegate,
+		session:     s,
+		initCtx:     initCtx,
+		markInited:  markInited,
+
+		speed: statistic.NewSpeed(),
+		dedup: dedupFor(s),
+		in:    packet.NewChan(4),
+	}
+	return qc
+}
+
+func (q *QuicChan) markInit(out packet.SendChan) {
+	q.out = out
+	q.markInited()
+}
+
+func (q *QuicChan) InitContext() context.Context {
+	return q.initCtx
+}
+
+func (q *QuicChan) IsSvrModeAndUninit() bool {
+	return q.out == nil
+}
+
+func (q *QuicChan) GetSpeed() *statistic.SpeedInfo {
+	return q.speed.GetSpeed()
+}
+
+func (q *QuicChan) HeartBeatClean(err error) {
+	q.SetError(logex.NewErrorf("clean: %v", err))
+	q.Stop()
+}
+
+func (q *QuicChan) Start(ctx context.Context) {
+	q.ctx = q.BaseService.Start(ctx)
+	q.heartBeat = statistic.NewHeartBeatStage(q.ctx, 5*time.Second, q)
+	q.OnStop(func() {
+		if err := q.Err(); err != nil {
+			logex.Info(q.Name(), "exit by:", err)
+		}
+		q.stream.Close()
+	})
+	go q.handshakeAndServe()
+}
+
+func (q *QuicChan) handshakeAndServe() {
+	buf := bufio.NewReader(q.stream)
+
+	deadline := time.Now().Add(handshakeTimeout)
+	if d, ok := q.ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	q.stream.SetReadDeadline(deadline)
+
+	if err := q.handshake(buf); err != nil {
+		q.SetError(logex.NewErrorf("handshake error: %v", err))
+		q.Stop()
+		return
+	}
+	q.stream.SetReadDeadline(time.Time{})
+	go q.writeLoop()
+	q.readLoop(buf)
+}
+
+// handshake mirrors HttpChan.handshake: the stream's own framing doesn't
+// help here since, like HttpChan, there's no session cipher yet to trust
+// an L2 frame with.
+func (q *QuicChan) handshake(buf *bufio.Reader) error {
+	if q.delegate != nil {
+		out, err := serverHandshake(q.ctx, q.stream, buf, q.session, q.delegate)
+		if err != nil {
+			return err
+		}
+		q.markInit(out)
+		q.delegate.OnInited(q)
+		return nil
+	}
+	return clientHandshake(q.stream, buf, q.session)
+}
+
+func (q *QuicChan) rawWrite(p []*packet.Packet) error {
+	l2 := packet.WrapL2(q.session, p)
+	n, err := q.stream.Write(l2.Bytes())
+	q.speed.Upload(n)
+	return err
+}
+
+func (q *QuicChan) writeLoop() {
+	heartBeatTicker := time.NewTicker(1 * time.Second)
+	defer heartBeatTicker.Stop()
+
+	var err error
+loop:
+	for {
+		select {
+		case <-q.ctx.Done():
+			break loop
+		case <-heartBeatTicker.C:
+			p := q.heartBeat.New()
+			err = q.rawWrite([]*packet.Packet{p})
+			q.heartBeat.Add(p)
+		case p := <-q.in:
+			err = q.rawWrite(p)
+		}
+		if err != nil {
+			q.SetError(logex.NewErrorf("write error: %v", err))
+			break
+		}
+	}
+	q.Stop()
+}
+
+func (q *QuicChan) readLoop(buf *bufio.Reader) {
+loop:
+	for q.ctx.Err() == nil {
+		deadline := time.Now().Add(5 * time.Second)
+		if d, ok := q.ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		q.stream.SetReadDeadline(deadline)
+		l2, err := packet.ReadL2(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok {
+				if nerr.Temporary() || nerr.Timeout() {
+					continue
+				}
+			}
+			q.SetError(logex.NewErrorf("read error: %v", err))
+			break
+		}
+
+		if err := l2.Verify(q.session); err != nil {
+			q.SetError(logex.NewErrorf("verify error: %v", err))
+			break
+		}
+
+		ps, err := l2.Unmarshal()
+		if err != nil {
+			q.SetError(logex.NewErrorf("client error: %v", err))
+			break
+		}
+		if !q.onRecePacket(ps) {
+			break loop
+		}
+	}
+	q.Stop()
+}
+
+func (q *QuicChan) onRecePacket(ps []*packet.Packet) bool {
+	buffer := make([]*packet.Packet, 0, len(ps))
+	for _, p := range ps {
+		q.speed.Download(p.Size())
+		switch p.Type {
+		case packet.HEARTBEAT:
+			if !q.in.SendSafeCtx(q.ctx, []*packet.Packet{p.Reply(p.Payload())}) {
+				return false
+			}
+		case packet.HEARTBEAT_R:
+			q.heartBeat.Receive(p)
+		case packet.ACK:
+			if g := ackFor(q.session); g != nil {
+				g.Ack(p.SeqID)
+			}
+		default:
+			// Duplicated send mode can land the same SeqID on more than
+			// one of a Group's channels; drop the repeat rather than
+			// deliver it twice.
+			if q.dedup.Seen(p.SeqID) {
+				continue
+			}
+			buffer = append(buffer, p)
+		}
+	}
+
+	if !q.out.SendSafeCtx(q.ctx, buffer) {
+		return false
+	}
+	return true
+}
+
+func (q *QuicChan) Latency() (time.Duration, time.Duration) {
+	return q.heartBeat.GetLatency()
+}
+
+func (q *QuicChan) ChanWrite() packet.SendChan {
+	return q.in.Send()
+}
+
+func (q *QuicChan) GetUserId() (int, error) {
+	return q.session.UserId(), nil
+}
+
+func (q *QuicChan) Name() string {
+	return "[quic " + q.sess.LocalAddr().String() + " -> " + q.sess.RemoteAddr().String() + "]"
+}
+
+func (q *QuicChan) GetStat() *statistic.HeartBeat {
+	return q.heartBeat.GetStat()
+}
+
+// QuicChanFactory dials (or accepts) a quic.Session and opens one stream
+// per logical channel on it, letting the connection's own multiplexing
+// stand in for the multiple TCP dials HttpChanFactory would otherwise need.
+type QuicChanFactory struct {
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+}
+
+func NewQuicChanFactory(tlsConfig *tls.Config, quicConfig *quic.Config) *QuicChanFactory {
+	return &QuicChanFactory{
+		tlsConfig:  tlsConfig,
+		quicConfig: quicConfig,
+	}
+}
+
+// DialClient opens a new QUIC session (or reuses sess if non-nil) to addr
+// and returns a client-side QuicChan ready to Start(ctx).
+func (f *QuicChanFactory) DialClient(addr string, session *packet.Session, sess quic.Session, out packet.SendChan) (*QuicChan, error) {
+	var err error
+	if sess == nil {
+		sess, err = quic.DialAddr(addr, f.tlsConfig, f.quicConfig)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+	}
+	stream, err := sess.OpenStreamSync()
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return NewQuicChanClient(session, sess, stream, out), nil
+}
+
+// AcceptServer waits for the next stream opened by the peer on sess and
+// returns a server-side QuicChan that will authenticate via delegate once
+// the first frame arrives.
+func (f *QuicChanFactory) AcceptServer(sess quic.Session, session *packet.Session, delegate SvrInitDelegate) (*QuicChan, error) {
+	stream, err := sess.AcceptStream()
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return NewQuicChanServer(session, sess, stream, delegate), nil
+}
@@ -0,0 +1,93 @@
+package dchan
+
+import (
+	"io"
+	"net"
+
+	"github.com/chzyer/logex"
+	"github.com/chzyer/next/packet"
+)
+
+// RelayChanFactory dials through a rendezvous relay server instead of
+// dialing the peer directly, for NAT-punching scenarios where a direct
+// dial fails. Once rendezvous is done the relay only proxies raw bytes
+// (the handshake frames, then L2 frames), so the handshake and
+// packet.WrapL2 / Verify on top of the resulting net.Conn continue to work
+// unchanged, which lets RelayChan reuse HttpChan as-is.
+type RelayChanFactory struct {
+	relayAddr string
+}
+
+func NewRelayChanFactory(relayAddr string) *RelayChanFactory {
+	return &RelayChanFactory{relayAddr: relayAddr}
+}
+
+// DialClient rendezvous-connects to peerID via the relay and returns a
+// client-side HttpChan running over the relayed connection, ready to
+// Start(ctx).
+func (f *RelayChanFactory) DialClient(session *packet.Session, peerID string, out packet.SendChan) (*HttpChan, error) {
+	conn, err := f.rendezvous(peerID)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return NewHttpChanClient(session, conn, out), nil
+}
+
+// AcceptServer waits for peerID to show up on the relay and returns a
+// server-side HttpChan, ready to Start(ctx); Start runs the handshake,
+// which authenticates the peer via delegate before any L2 frame is read.
+func (f *RelayChanFactory) AcceptServer(session *packet.Session, peerID string, delegate SvrInitDelegate) (*HttpChan, error) {
+	conn, err := f.rendezvous(peerID)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return NewHttpChanServer(session, conn, delegate), nil
+}
+
+// rendezvous dials the relay, announces peerID and waits for the relay to
+// pair us with the other side of that id, handing back a net.Conn that
+// behaves like a direct connection to the peer from that point on.
+func (f *RelayChanFactory) rendezvous(peerID string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", f.relayAddr)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if _, err := conn.Write([]byte("RELAY " + peerID + "\n")); err != nil {
+		conn.Close()
+		return nil, logex.Trace(err)
+	}
+	// Read the reply byte-by-byte rather than through a bufio.Reader: once
+	// rendezvous succeeds the peer may start writing its handshake on the
+	// very same conn immediately after the relay's "OK\n", and a
+	// bufio.Reader here would buffer (and silently drop, once it goes out
+	// of scope) whatever of that arrived in the same read as the reply.
+	reply, err := readRelayLine(conn)
+	if err != nil {
+		conn.Close()
+		return nil, logex.Trace(err)
+	}
+	if reply != "OK\n" {
+		conn.Close()
+		return nil, logex.NewErrorf("relay: rendezvous with %v failed: %v", peerID, reply)
+	}
+	return conn, nil
+}
+
+// readRelayLine reads one byte at a time up to and including the next
+// '\n', so it never consumes bytes past the line it was asked to read.
+func readRelayLine(r io.Reader) (string, error) {
+	var line []byte
+	var b [1]byte
+	for {
+		n, err := r.Read(b[:])
+		if n > 0 {
+			line = append(line, b[0])
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err != nil {
+			return string(line), err
+		}
+	}
+}
@@ -0,0 +1,120 @@
+// Package service provides a small Start/Stop lifecycle base, analogous to
+// tendermint's service base, so dchan.HttpChan, dchan.Group and
+// server.Shell stop each reinventing Start/Stop bookkeeping with their own
+// flavour of flow.Flow, sync.Once-ish MarkExit and error stashing.
+package service
+
+import (
+	"context"
+	"sync"
+)
+
+// BaseService is meant to be embedded: the embedding type gets Start, Stop,
+// Wait, IsRunning, Err and OnStop for free, and supplies its own
+// constructor plus whatever Start(ctx) needs to kick off.
+type BaseService struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+	running bool
+	err     error
+	onStop  []func()
+}
+
+func NewBaseService() *BaseService {
+	return &BaseService{done: make(chan struct{})}
+}
+
+// Start marks the service running and returns a context derived from ctx
+// that is cancelled by Stop. Calling Start again while already running is
+// a no-op that returns the existing context; calling it again after Stop
+// restarts the service, with a fresh done channel and OnStop list so a
+// second Start/Stop cycle behaves exactly like the first.
+func (b *BaseService) Start(ctx context.Context) context.Context {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running {
+		return b.ctx
+	}
+	if b.ctx != nil {
+		// restarting after Stop: the old done is closed and the old
+		// callbacks have run.
+		b.done = make(chan struct{})
+		b.onStop = nil
+	}
+	b.ctx, b.cancel = context.WithCancel(ctx)
+	b.err = nil
+	b.running = true
+	return b.ctx
+}
+
+// Stop cancels the service's context, runs every OnStop callback (in the
+// order they were registered) and unblocks Wait. Safe to call more than
+// once or before Start.
+func (b *BaseService) Stop() {
+	b.mu.Lock()
+	if !b.running {
+		b.mu.Unlock()
+		return
+	}
+	b.running = false
+	cancel := b.cancel
+	done := b.done
+	onStop := b.onStop
+	b.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+	for _, f := range onStop {
+		f()
+	}
+	close(done)
+}
+
+// Wait blocks until Stop has run. It grabs the current done channel under
+// the lock first rather than reading b.done directly, since a concurrent
+// Start (restarting a stopped service) reassigns b.done.
+func (b *BaseService) Wait() {
+	b.mu.Lock()
+	done := b.done
+	b.mu.Unlock()
+	<-done
+}
+
+func (b *BaseService) IsRunning() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.running
+}
+
+// Err returns whatever SetError last recorded, e.g. the reason a read/write
+// loop exited. Overwritten by SetError and cleared by Start; a clean stop
+// leaves it nil.
+func (b *BaseService) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.err
+}
+
+// SetError records the error Err will later report. Call before Stop so
+// OnStop callbacks can log it.
+func (b *BaseService) SetError(err error) {
+	b.mu.Lock()
+	b.err = err
+	b.mu.Unlock()
+}
+
+// OnStop registers f to run when Stop is called. If the service has
+// already stopped, f runs immediately instead.
+func (b *BaseService) OnStop(f func()) {
+	b.mu.Lock()
+	if !b.running && b.ctx != nil {
+		b.mu.Unlock()
+		f()
+		return
+	}
+	b.onStop = append(b.onStop, f)
+	b.mu.Unlock()
+}
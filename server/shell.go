@@ -1,12 +1,20 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/chzyer/flagly"
 	"github.com/chzyer/logex"
+	"github.com/chzyer/next/internal/service"
 	"github.com/chzyer/readline"
 	"github.com/google/shlex"
 )
@@ -14,33 +22,141 @@ import (
 var Slogan = `
    _  _______  ________
   / |/ / __/ |/_/_  __/
- /    / _/_>  <  / /   
-/_/|_/___/_/|_| /_/    
+ /    / _/_>  <  / /
+/_/|_/___/_/|_| /_/
 `
 
+// adminCommands lists the ShellCLI handler fields (lowercased) restricted
+// to admin principals. A unix-socket Shell has no authFn and treats every
+// connection as admin, since reaching the socket already implies local
+// root access; a NewShellTCP Shell enforces this against whatever authFn
+// decided.
+var adminCommands = map[string]bool{
+	"debug": true,
+	"dchan": true,
+}
+
+// ShellAuthFunc verifies a challenge/response pair produced by the
+// connecting client (an HMAC over nonce with a shared secret, or an
+// ed25519 signature of nonce, depending on what the caller configured) and
+// returns the principal it belongs to and whether that principal may run
+// admin-only commands.
+type ShellAuthFunc func(nonce, response []byte) (principal string, admin bool, err error)
+
 type Shell struct {
-	sock string
-	conn net.Listener
-	svr  *Server
+	*service.BaseService
+	ctx context.Context
+
+	sock     string
+	isUnix   bool
+	conn     net.Listener
+	svr      *Server
+	authFn   ShellAuthFunc
 }
 
+// NewShell listens on a unix socket. Since only local root can reach the
+// socket, every connection is treated as an authenticated admin.
 func NewShell(svr *Server, sock string) (*Shell, error) {
 	ln, err := net.Listen("unix", sock)
 	if err != nil {
 		return nil, err
 	}
 	sh := &Shell{
-		sock: sock,
-		conn: ln,
-		svr:  svr,
+		BaseService: service.NewBaseService(),
+		sock:        sock,
+		isUnix:      true,
+		conn:        ln,
+		svr:         svr,
 	}
 	return sh, nil
 }
 
-func (s *Shell) handleConn(conn net.Conn) {
+// NewShellTCP listens on addr over TLS; handleConn runs authFn's
+// challenge/response before a connection reaches readline, so the shell can be
+// administered remotely without exposing the whole box the way an open
+// unix socket would.
+func NewShellTCP(svr *Server, addr string, tlsConfig *tls.Config, authFn ShellAuthFunc) (*Shell, error) {
+	ln, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	sh := &Shell{
+		BaseService: service.NewBaseService(),
+		sock:        addr,
+		conn:        ln,
+		svr:         svr,
+		authFn:      authFn,
+	}
+	return sh, nil
+}
+
+// Start registers the listener teardown and kicks off the accept loop.
+func (s *Shell) Start(ctx context.Context) {
+	s.ctx = s.BaseService.Start(ctx)
+	s.OnStop(func() {
+		s.conn.Close()
+		if s.isUnix {
+			os.Remove(s.sock)
+		}
+	})
+	go s.loop()
+}
+
+// authTimeout bounds how long authenticate waits for the challenge/response
+// exchange, the same way dchan's handshakeTimeout bounds its handshake: an
+// unauthenticated client on the remote TCP/TLS listener shouldn't be able to
+// pin a conn and a handleConn goroutine open forever by never responding.
+const authTimeout = 10 * time.Second
+
+// authenticate sends conn a random nonce and asks authFn to verify
+// whatever comes back, returning the principal authFn vouches for.
+func (s *Shell) authenticate(conn net.Conn) (string, bool, error) {
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", false, logex.Trace(err)
+	}
+	if err := writeShellFrame(conn, nonce); err != nil {
+		return "", false, logex.Trace(err)
+	}
+	response, err := readShellFrame(conn)
+	if err != nil {
+		return "", false, logex.Trace(err)
+	}
+	principal, admin, err := s.authFn(nonce, response)
+	if err != nil {
+		return "", false, logex.Trace(err)
+	}
+	return principal, admin, nil
+}
+
+// handleConn serves one shell connection. ctx is derived from the shell's
+// own lifetime so per-connection work (and any read deadlines it sets) is
+// cancelled the moment the shell is closed; it's further narrowed to a
+// per-connection context here so the watcher goroutine below exits as soon
+// as this connection ends, rather than leaking until the shell does.
+func (s *Shell) handleConn(ctx context.Context, conn net.Conn) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
 
-	sh := &ShellCLI{}
+	principal, admin := "root", true
+	if s.authFn != nil {
+		var err error
+		principal, admin, err = s.authenticate(conn)
+		if err != nil {
+			logex.Info("shell: auth failed:", err)
+			return
+		}
+	}
+
+	sh := &ShellCLI{principal: principal, admin: admin}
 	fset, err := flagly.Compile("", sh)
 	if err != nil {
 		logex.Info(err)
@@ -48,7 +164,7 @@ func (s *Shell) handleConn(conn net.Conn) {
 	}
 
 	cfg := readline.Config{
-		Prompt:       "server> ",
+		Prompt:       fmt.Sprintf("%v@server> ", principal),
 		AutoComplete: readline.SegmentAutoComplete(fset.Completer()),
 	}
 	rl, err := readline.HandleConn(cfg, conn)
@@ -76,6 +192,11 @@ func (s *Shell) handleConn(conn net.Conn) {
 			continue
 		}
 
+		if len(args) > 0 && adminCommands[strings.ToLower(args[0])] && !sh.admin {
+			fmt.Fprintln(rl.Stderr(), "permission denied:", args[0], "is admin-only")
+			continue
+		}
+
 		if err := fset.Run(args); err != nil {
 			fmt.Fprintln(rl.Stderr(), err)
 			continue
@@ -89,13 +210,44 @@ func (s *Shell) loop() {
 		if err != nil {
 			break
 		}
-		go s.handleConn(conn)
+		go s.handleConn(s.ctx, conn)
 	}
 }
 
-func (s *Shell) Close() {
-	s.conn.Close()
-	os.Remove(s.sock)
+// writeShellFrame/readShellFrame are a minimal length-prefixed framing for
+// the pre-readline auth handshake, kept local to this file rather than
+// reused from dchan's handshake framing so the shell's auth story doesn't
+// depend on the dchan package.
+func writeShellFrame(w io.Writer, p []byte) error {
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(p)))
+	if _, err := w.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(p)
+	return err
+}
+
+// maxShellFrame caps readShellFrame's allocation. This runs in
+// authenticate, before any credential is checked, so an unbounded length
+// prefix would let any client that completes the TLS handshake force a
+// multi-GB allocation per connection.
+const maxShellFrame = 1 << 20
+
+func readShellFrame(r io.Reader) ([]byte, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(lenBuf[:])
+	if n > maxShellFrame {
+		return nil, logex.NewErrorf("shell: frame too large (%v bytes)", n)
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 type ShellCLI struct {
@@ -103,4 +255,11 @@ type ShellCLI struct {
 	User  ShellUser      `flagly:"handler"`
 	Debug *ShellDebug    `flagly:"handler"`
 	Dchan *Dchan         `flagly:"handler"`
+
+	// principal and admin are filled in per-connection by handleConn, not
+	// by flagly. handleConn shows principal in the prompt and checks admin
+	// against adminCommands; neither is passed to the command handlers, so
+	// handlers such as User do not see who ran them.
+	principal string
+	admin     bool
 }